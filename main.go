@@ -12,6 +12,8 @@ import (
 
 func main() {
 	var config smallpng.Config
+	var quantizer string
+	var dither string
 	flag.BoolVar(&config.NoPalette, "no-palette", false,
 		"use the original color space, not a palette")
 	flag.IntVar(&config.PaletteSize, "palette-size", smallpng.DefaultPaletteSize,
@@ -20,9 +22,21 @@ func main() {
 		"maximum number of pixels to use as data points for clustering")
 	flag.IntVar(&config.MaxIters, "max-iters", smallpng.DefaultMaxKMeansIters,
 		"maximum number of clustering iterations (more iterations means better clusters)")
+	flag.StringVar(&quantizer, "quantizer", "kmeans",
+		"palette algorithm to use: kmeans or octree")
+	flag.StringVar(&dither, "dither", "none",
+		"pixel-to-palette mapping to use: none, floyd-steinberg, or ordered")
+	flag.StringVar(&config.InputFormat, "input-format", "",
+		"input format (png, jpeg, gif, bmp, webp); required when input is \"-\" (stdin)")
+	flag.IntVar(&config.MaxMemoryBytes, "max-memory-bytes", smallpng.DefaultMaxMemoryBytes,
+		"if non-zero, process the image in tiles bounded to roughly this many bytes each")
+	flag.IntVar(&config.MiniBatchSize, "mini-batch-size", 0,
+		"if non-zero, use mini-batch k-means with this many samples per iteration")
+	flag.Int64Var(&config.Seed, "seed", 0,
+		"if non-zero, seed palette generation for reproducible output")
 
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "[flags] <input.png> [output.png]")
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "[flags] <input.png|-> [output.png]")
 		fmt.Fprintln(os.Stderr)
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr)
@@ -35,18 +49,52 @@ func main() {
 		flag.Usage()
 	}
 
+	switch quantizer {
+	case "kmeans":
+		config.QuantizerMethod = smallpng.KMeans
+	case "octree":
+		config.QuantizerMethod = smallpng.Octree
+	default:
+		essentials.Must(fmt.Errorf("unknown -quantizer: %s", quantizer))
+	}
+
+	switch dither {
+	case "none":
+		config.Dither = smallpng.DitherNone
+	case "floyd-steinberg":
+		config.Dither = smallpng.DitherFloydSteinberg
+	case "ordered":
+		config.Dither = smallpng.DitherOrdered
+	default:
+		essentials.Must(fmt.Errorf("unknown -dither: %s", dither))
+	}
+
 	inputPath := flag.Args()[0]
 	outputPath := inputPath
 	if len(flag.Args()) == 2 {
 		outputPath = flag.Args()[1]
 	}
 
-	inStats, err := os.Stat(inputPath)
-	essentials.Must(err)
+	if inputPath == "-" && len(flag.Args()) != 2 {
+		essentials.Must(fmt.Errorf("an output path is required when reading from stdin"))
+	}
+
+	var inStats os.FileInfo
+	if inputPath != "-" {
+		var err error
+		inStats, err = os.Stat(inputPath)
+		essentials.Must(err)
+	}
+
 	essentials.Must(smallpng.CompressImage(inputPath, outputPath, &config))
 	outStats, err := os.Stat(outputPath)
 	essentials.Must(err)
 
+	if inStats == nil {
+		fmt.Printf("- -> %s\n", humanize.Bytes(uint64(outStats.Size())))
+		return
+	}
+
 	fracReduction := float64(inStats.Size()-outStats.Size()) / float64(inStats.Size())
 	fmt.Printf(
 		"%s -> %s (%.1f%% reduction)",
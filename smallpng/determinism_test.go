@@ -0,0 +1,86 @@
+package smallpng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// randomImage returns a deterministic but non-trivial test
+// image with more distinct colors than fit in the palette,
+// so clustering actually has work to do.
+func randomImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{
+				R: uint8(x * 4),
+				G: uint8(y * 4),
+				B: uint8((x * y) % 256),
+				A: 0xff,
+			})
+		}
+	}
+	return img
+}
+
+// TestPaletteImageSeedDeterministic verifies that a fixed
+// Seed produces byte-identical encoded output across
+// independent runs, even though palette generation uses
+// randomized subsampling and k-means++ initialization.
+func TestPaletteImageSeedDeterministic(t *testing.T) {
+	img := randomImage()
+	newConfig := func() *PaletteConfig {
+		return &PaletteConfig{
+			PaletteSize:      8,
+			MaxClusterPixels: 256,
+			Seed:             1234,
+		}
+	}
+
+	encode := func() []byte {
+		res := PaletteImage(img, newConfig())
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, res); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	first := encode()
+	second := encode()
+	if !bytes.Equal(first, second) {
+		t.Errorf("encoded output differs across runs with the same seed")
+	}
+}
+
+// TestPaletteImageSeedDeterministicConfigReuse verifies that
+// passing the very same *PaletteConfig to two separate
+// PaletteImage calls still produces identical output: seeding
+// must not advance any state stored back into the caller's
+// config.
+func TestPaletteImageSeedDeterministicConfigReuse(t *testing.T) {
+	img := randomImage()
+	cfg := &PaletteConfig{
+		PaletteSize:      8,
+		MaxClusterPixels: 256,
+		Seed:             1234,
+	}
+
+	encode := func() []byte {
+		res := PaletteImage(img, cfg)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, res); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	first := encode()
+	second := encode()
+	if !bytes.Equal(first, second) {
+		t.Errorf("encoded output differs across calls reusing the same *PaletteConfig")
+	}
+}
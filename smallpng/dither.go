@@ -0,0 +1,160 @@
+package smallpng
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Dither selects how PaletteImage maps each source pixel
+// to a palette entry.
+type Dither int
+
+const (
+	// DitherNone maps every pixel to its single nearest
+	// palette entry. This is the fastest option but can
+	// produce visible banding on photographic input.
+	DitherNone Dither = iota
+
+	// DitherFloydSteinberg diffuses each pixel's
+	// quantization error onto its right and below
+	// neighbors using the classic Floyd-Steinberg weights,
+	// trading banding for fine-grained noise.
+	DitherFloydSteinberg
+
+	// DitherOrdered adds a per-pixel threshold offset taken
+	// from a Bayer matrix before quantizing, which avoids
+	// the "worm" artifacts of error diffusion at the cost
+	// of a visible repeating pattern.
+	DitherOrdered
+)
+
+// bayer8x8 is the standard 8x8 Bayer threshold matrix,
+// with entries in [0, 63].
+var bayer8x8 = [8][8]int{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// ditherImage quantizes the pixels of img within bounds to
+// the given palette using the color space and dither method
+// from p, writing the result into res. bounds is usually
+// img.Bounds(), but may be a sub-rectangle (e.g. one tile of
+// a larger image) to bound the working set of error
+// diffusion.
+func ditherImage(res *image.Paletted, img image.Image, bounds image.Rectangle, palette color.Palette, p *PaletteConfig) {
+	vectors := make([]colorVector, len(palette))
+	for i, c := range palette {
+		vectors[i] = p.ColorSpace.toVector(c)
+	}
+
+	switch p.Dither {
+	case DitherFloydSteinberg:
+		ditherFloydSteinberg(res, img, bounds, vectors, p.ColorSpace)
+	case DitherOrdered:
+		ditherOrdered(res, img, bounds, vectors, p.ColorSpace)
+	default:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				v := p.ColorSpace.toVector(img.At(x, y))
+				res.SetColorIndex(x, y, uint8(nearestPaletteIndex(vectors, v)))
+			}
+		}
+	}
+}
+
+func nearestPaletteIndex(vectors []colorVector, v colorVector) int {
+	bestIdx := 0
+	bestDist := v.DistSquared(vectors[0])
+	for i := 1; i < len(vectors); i++ {
+		d := v.DistSquared(vectors[i])
+		if d < bestDist {
+			bestDist = d
+			bestIdx = i
+		}
+	}
+	return bestIdx
+}
+
+func ditherFloydSteinberg(res *image.Paletted, img image.Image, bounds image.Rectangle, vectors []colorVector, cs ColorSpace) {
+	w := bounds.Dx()
+
+	// errors[(y-bounds.Min.Y)%2] holds the diffused error for
+	// the row currently being processed; the other slice holds
+	// the error already diffused into the next row.
+	errors := [2][]colorVector{make([]colorVector, w+2), make([]colorVector, w+2)}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cur := errors[(y-bounds.Min.Y)%2]
+		next := errors[(y-bounds.Min.Y+1)%2]
+		for i := range next {
+			next[i] = colorVector{}
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			col := x - bounds.Min.X
+			v := cs.toVector(img.At(x, y)).Add(cur[col+1])
+			idx := nearestPaletteIndex(vectors, v)
+			res.SetColorIndex(x, y, uint8(idx))
+
+			residual := v.Add(vectors[idx].Scale(-1))
+			cur[col+2] = cur[col+2].Add(residual.Scale(7.0 / 16.0))
+			next[col] = next[col].Add(residual.Scale(3.0 / 16.0))
+			next[col+1] = next[col+1].Add(residual.Scale(5.0 / 16.0))
+			next[col+2] = next[col+2].Add(residual.Scale(1.0 / 16.0))
+		}
+	}
+}
+
+func ditherOrdered(res *image.Paletted, img image.Image, bounds image.Rectangle, vectors []colorVector, cs ColorSpace) {
+	scale := averageNearestNeighborDist(vectors)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			threshold := float32(bayer8x8[y&7][x&7])/64.0 - 0.5
+			v := cs.toVector(img.At(x, y)).Add(colorVector{}.offset(threshold * scale))
+			idx := nearestPaletteIndex(vectors, v)
+			res.SetColorIndex(x, y, uint8(idx))
+		}
+	}
+}
+
+// offset returns a copy of c with every component shifted
+// by the same amount, used to apply an ordered-dither
+// threshold uniformly across channels.
+func (c colorVector) offset(amount float32) colorVector {
+	for i := range c {
+		c[i] += amount
+	}
+	return c
+}
+
+// averageNearestNeighborDist computes the average distance
+// from each palette entry to its single closest neighbor,
+// used to scale ordered-dither threshold offsets to the
+// palette's own density.
+func averageNearestNeighborDist(vectors []colorVector) float32 {
+	if len(vectors) < 2 {
+		return 0
+	}
+	var sum float32
+	for i, v := range vectors {
+		best := float32(-1)
+		for j, v1 := range vectors {
+			if i == j {
+				continue
+			}
+			d := v.DistSquared(v1)
+			if best < 0 || d < best {
+				best = d
+			}
+		}
+		sum += float32(math.Sqrt(float64(best)))
+	}
+	return sum / float32(len(vectors))
+}
@@ -0,0 +1,54 @@
+package smallpng
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// KMeansQuantizer adapts PaletteImage's palette generation
+// to the standard image/draw.Quantizer interface, so
+// smallpng can be plugged directly into gif.Encode and other
+// draw-based pipelines.
+type KMeansQuantizer struct {
+	PaletteConfig
+}
+
+// Quantize implements draw.Quantizer. Any colors already in
+// p are kept as-is. If p has spare capacity, up to the
+// smaller of cap(p)-len(p) and PaletteSize colors built from
+// m's pixels are appended; if it has none (e.g. a nil p), up
+// to PaletteSize colors are appended.
+func (q *KMeansQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	cfg := q.PaletteConfig.setDefaults()
+	if room := cap(p) - len(p); room > 0 && room < cfg.PaletteSize {
+		cfg.PaletteSize = room
+	}
+	return append(p, paletteFor(m, &cfg)...)
+}
+
+// KMeansDrawer adapts KMeansQuantizer to the standard
+// image/draw.Drawer interface: it builds a palette for src
+// and maps every destination pixel to its nearest entry.
+type KMeansDrawer struct {
+	PaletteConfig
+}
+
+// Draw implements draw.Drawer.
+func (d *KMeansDrawer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	cfg := d.PaletteConfig.setDefaults()
+	palette := paletteFor(src, &cfg)
+	vectors := make([]colorVector, len(palette))
+	for i, c := range palette {
+		vectors[i] = cfg.ColorSpace.toVector(c)
+	}
+
+	dx := sp.X - r.Min.X
+	dy := sp.Y - r.Min.Y
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := cfg.ColorSpace.toVector(src.At(x+dx, y+dy))
+			dst.Set(x, y, palette[nearestPaletteIndex(vectors, v)])
+		}
+	}
+}
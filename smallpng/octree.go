@@ -0,0 +1,314 @@
+package smallpng
+
+import (
+	"container/heap"
+	"image"
+	"image/color"
+)
+
+// octreeDepth is the number of bits of each color channel
+// that are indexed by the octree, i.e. the maximum depth
+// of the tree.
+const octreeDepth = 8
+
+// octreeNode is a single node of a color octree. Only
+// emittable leaves hold a summed color and pixel count:
+// Insert adds each pixel to a depth-octreeDepth leaf, and
+// Reduce adds its children's sums into a node before
+// discarding the children.
+type octreeNode struct {
+	r, g, b uint64
+	count   uint64
+
+	// weight is the total number of pixels inserted through
+	// this node, whether they ended up here directly (a leaf)
+	// or under one of its descendants. Unlike count, which is
+	// only ever nonzero on emittable leaves, weight is kept
+	// up to date on every node on the path from the root, so
+	// reducible interior nodes can be ordered by how many
+	// pixels their subtree actually represents.
+	weight uint64
+
+	depth    int
+	parent   *octreeNode
+	children [8]*octreeNode
+
+	// heapIndex is maintained by nodeHeap so that a node's
+	// position can be fixed up in-place when its weight
+	// changes.
+	heapIndex int
+}
+
+func (n *octreeNode) isLeaf() bool {
+	for _, c := range n.children {
+		if c != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *octreeNode) color() color.RGBA64 {
+	if n.count == 0 {
+		return color.RGBA64{}
+	}
+	return color.RGBA64{
+		R: uint16(n.r / n.count),
+		G: uint16(n.g / n.count),
+		B: uint16(n.b / n.count),
+		A: 0xffff,
+	}
+}
+
+// childIndex computes which of a node's eight children a
+// pixel belongs to at the given depth, by extracting one
+// bit from each of the R, G, and B channels.
+func childIndex(r, g, b uint32, depth int) int {
+	shift := uint(15 - depth)
+	idx := 0
+	if (r>>shift)&1 != 0 {
+		idx |= 4
+	}
+	if (g>>shift)&1 != 0 {
+		idx |= 2
+	}
+	if (b>>shift)&1 != 0 {
+		idx |= 1
+	}
+	return idx
+}
+
+// octree incrementally builds a color palette by indexing
+// pixels into a tree of depth octreeDepth, then merging
+// the least-populated nodes at the deepest level until the
+// number of leaves is within a target budget.
+type octree struct {
+	root *octreeNode
+
+	// reducible holds, for each depth, the interior nodes
+	// at that depth that have at least one child and whose
+	// children (however many of the 8 slots are filled) are
+	// all leaves. A node is pushed here the moment it gains
+	// its first such child, and popped when it is folded back
+	// into a leaf.
+	reducible [octreeDepth]*nodeHeap
+
+	leafCount int
+}
+
+func newOctree() *octree {
+	t := &octree{
+		root: &octreeNode{depth: 0},
+	}
+	for i := range t.reducible {
+		t.reducible[i] = &nodeHeap{}
+		heap.Init(t.reducible[i])
+	}
+	return t
+}
+
+// Insert adds a pixel's color to the tree.
+func (t *octree) Insert(co color.Color) {
+	r, g, b, _ := co.RGBA()
+	node := t.root
+	t.touchWeight(node)
+	for depth := 0; depth < octreeDepth; depth++ {
+		// wasLeaf is true only if node was already an
+		// emittable leaf (i.e. it previously accumulated
+		// color, either as a depth-octreeDepth node or as a
+		// node folded by Reduce). Fresh interior nodes are
+		// leaves too (no children yet) but were never counted
+		// in leafCount, so they must not decrement it.
+		wasLeaf := node.isLeaf() && node.count > 0
+		idx := childIndex(r, g, b, depth)
+		child := node.children[idx]
+		if child == nil {
+			child = &octreeNode{depth: depth + 1, parent: node}
+			node.children[idx] = child
+			if wasLeaf {
+				t.leafCount--
+			}
+			if depth == octreeDepth-1 {
+				t.leafCount++
+			}
+		}
+		node = child
+		t.touchWeight(node)
+	}
+	node.r += uint64(r)
+	node.g += uint64(g)
+	node.b += uint64(b)
+	node.count++
+	t.markReducibleChain(node.parent)
+}
+
+// touchWeight records that one more pixel has been inserted
+// through node. If node is already sitting in its depth's
+// reducible heap, its position is fixed up in place so the
+// heap's ordering stays correct as weights change underneath
+// it.
+func (t *octree) touchWeight(node *octreeNode) {
+	node.weight++
+	if node.heapIndex != 0 {
+		heap.Fix(t.reducible[node.depth], node.heapIndex-1)
+	}
+}
+
+// allSiblingsPresent reports whether node is a candidate for
+// Reduce: it must have at least one child, and every child it
+// has (whether or not all 8 slots are filled) must itself
+// already be a leaf. Reduce folds a child's accumulated color
+// directly into node without recursing into the child's own
+// descendants, so a non-leaf child would lose data.
+func (t *octree) allSiblingsPresent(node *octreeNode) bool {
+	any := false
+	for _, c := range node.children {
+		if c == nil {
+			continue
+		}
+		if !c.isLeaf() {
+			return false
+		}
+		any = true
+	}
+	return any
+}
+
+// markReducibleChain walks upward from node, pushing any
+// ancestor that is a Reduce candidate onto its reducible
+// bucket. The walk stops as soon as an ancestor isn't a
+// candidate, since none of its ancestors can be either until
+// it becomes a leaf itself (via Reduce).
+func (t *octree) markReducibleChain(node *octreeNode) {
+	for node != nil && t.allSiblingsPresent(node) {
+		t.pushReducible(node)
+		node = node.parent
+	}
+}
+
+func (t *octree) pushReducible(node *octreeNode) {
+	h := t.reducible[node.depth]
+	if node.heapIndex != 0 || (h.Len() > 0 && (*h)[0] == node) {
+		return
+	}
+	heap.Push(h, node)
+}
+
+// Reduce folds the children of the least-populated node at
+// the deepest available level back into that node, turning
+// it into a leaf. It returns false if there is nothing left
+// to reduce.
+func (t *octree) Reduce() bool {
+	for depth := octreeDepth - 1; depth >= 0; depth-- {
+		h := t.reducible[depth]
+		if h.Len() == 0 {
+			continue
+		}
+		node := heap.Pop(h).(*octreeNode)
+		merged := 0
+		for i, c := range node.children {
+			if c == nil {
+				continue
+			}
+			node.r += c.r
+			node.g += c.g
+			node.b += c.b
+			node.count += c.count
+			node.children[i] = nil
+			merged++
+		}
+		t.leafCount -= merged - 1
+		// node is now a leaf; its parent may have become
+		// reducible as a result.
+		t.markReducibleChain(node.parent)
+		return true
+	}
+	return false
+}
+
+// Leaves returns every remaining leaf in depth-first order.
+func (t *octree) Leaves() []*octreeNode {
+	var leaves []*octreeNode
+	var walk func(n *octreeNode)
+	walk = func(n *octreeNode) {
+		if n.isLeaf() {
+			if n.count > 0 {
+				leaves = append(leaves, n)
+			}
+			return
+		}
+		for _, c := range n.children {
+			if c != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(t.root)
+	return leaves
+}
+
+// nodeHeap is a container/heap of octree nodes ordered by
+// ascending subtree weight, used to repeatedly find the
+// least-populated reducible node at a given depth. count
+// can't be used for this: it is only ever set on emittable
+// leaves, so every reducible (interior) node would compare
+// equal.
+type nodeHeap []*octreeNode
+
+func (h nodeHeap) Len() int           { return len(h) }
+func (h nodeHeap) Less(i, j int) bool { return h[i].weight < h[j].weight }
+func (h nodeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i + 1
+	h[j].heapIndex = j + 1
+}
+
+func (h *nodeHeap) Push(x interface{}) {
+	n := x.(*octreeNode)
+	n.heapIndex = len(*h) + 1
+	*h = append(*h, n)
+}
+
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	x.heapIndex = 0
+	*h = old[:n-1]
+	return x
+}
+
+// octreePalette builds a palette of at most paletteSize
+// colors from img using a single-pass color octree. Unlike
+// the k-means path, this does not subsample pixels or use
+// randomness, so it is both faster and fully deterministic.
+func octreePalette(img image.Image, paletteSize int) color.Palette {
+	return octreePaletteMulti([]image.Image{img}, paletteSize)
+}
+
+// octreePaletteMulti builds a single octree palette shared
+// across every image in imgs.
+func octreePaletteMulti(imgs []image.Image, paletteSize int) color.Palette {
+	tree := newOctree()
+	for _, img := range imgs {
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				tree.Insert(img.At(x, y))
+			}
+		}
+	}
+	for tree.leafCount > paletteSize {
+		if !tree.Reduce() {
+			break
+		}
+	}
+
+	leaves := tree.Leaves()
+	palette := make(color.Palette, len(leaves))
+	for i, leaf := range leaves {
+		palette[i] = leaf.color()
+	}
+	return palette
+}
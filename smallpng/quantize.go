@@ -3,9 +3,11 @@ package smallpng
 import (
 	"image"
 	"image/color"
+	"math"
 	"math/rand"
 	"runtime"
 	"sync"
+	"time"
 )
 
 // DefaultMaxKMeansIters is the default maximum number of
@@ -20,6 +22,28 @@ const DefaultPaletteSize = 256
 // to randomly subsample from an image for clustering.
 const DefaultMaxClusterPixels = 100000
 
+// DefaultMaxMemoryBytes is the default per-tile memory
+// bound for StreamPaletteImage. Since it is 0, tiling is
+// disabled unless a caller opts in explicitly.
+const DefaultMaxMemoryBytes = 0
+
+// QuantizerMethod selects the algorithm PaletteImage uses
+// to turn an image's pixels into a color palette.
+type QuantizerMethod int
+
+const (
+	// KMeans builds a palette by clustering a random
+	// subsample of pixels with k-means, using k-means++
+	// initialization. This is the default.
+	KMeans QuantizerMethod = iota
+
+	// Octree builds a palette in a single deterministic
+	// pass using a color octree. It runs in bounded memory
+	// with no random subsampling, trading some palette
+	// quality for speed and reproducibility.
+	Octree
+)
+
 // PaletteConfig determines how palette's are produced for
 // images.
 type PaletteConfig struct {
@@ -41,8 +65,48 @@ type PaletteConfig struct {
 	// If unspecified, the zero value for ColorSpace is
 	// used.
 	ColorSpace ColorSpace
+
+	// QuantizerMethod selects the palette-generation
+	// algorithm. If unspecified, KMeans is used.
+	QuantizerMethod QuantizerMethod
+
+	// Dither selects how pixels are mapped onto the
+	// generated palette. If unspecified, DitherNone is
+	// used.
+	Dither Dither
+
+	// MaxMemoryBytes bounds the working memory used per
+	// tile by StreamPaletteImage, which picks a tile height
+	// accordingly. If 0 (DefaultMaxMemoryBytes), tiling is
+	// disabled and the whole image is processed at once.
+	// Ignored by PaletteImage.
+	MaxMemoryBytes int
+
+	// MiniBatchSize, if non-zero, switches k-means clustering
+	// from full-batch Lloyd iterations (with Elkan's
+	// triangle-inequality pruning) to Sculley-style
+	// mini-batch updates, sampling this many points per
+	// iteration. Ignored by Octree.
+	MiniBatchSize int
+
+	// Seed seeds every random number generator used while
+	// building the palette (subsampling, k-means++
+	// initialization, and mini-batch sampling). If 0, a
+	// seed is derived from the current time, so output is
+	// not reproducible across runs unless Seed is set
+	// explicitly.
+	Seed int64
+
+	rng *rand.Rand
 }
 
+// setDefaults returns a copy of p with zero-valued fields
+// replaced by their defaults and rng seeded from Seed. Callers
+// must use the returned value (e.g. cfg := p.setDefaults())
+// rather than writing it back into p: persisting rng onto a
+// caller-owned *PaletteConfig would make a second call reuse
+// the already-advanced generator instead of reseeding from
+// Seed, breaking reproducibility across repeated calls.
 func (p PaletteConfig) setDefaults() PaletteConfig {
 	if p.MaxKMeansIters == 0 {
 		p.MaxKMeansIters = DefaultMaxKMeansIters
@@ -53,6 +117,13 @@ func (p PaletteConfig) setDefaults() PaletteConfig {
 	if p.MaxClusterPixels == 0 {
 		p.MaxClusterPixels = DefaultMaxClusterPixels
 	}
+	if p.rng == nil {
+		seed := p.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		p.rng = rand.New(rand.NewSource(seed))
+	}
 	return p
 }
 
@@ -65,18 +136,76 @@ func PaletteImage(img image.Image, p *PaletteConfig) *image.Paletted {
 	if p == nil {
 		p = &PaletteConfig{}
 	}
-	*p = p.setDefaults()
+	cfg := p.setDefaults()
+
+	palette := paletteFor(img, &cfg)
 
+	bounds := img.Bounds()
+	res := image.NewPaletted(bounds, palette)
+	ditherImage(res, img, bounds, palette, &cfg)
+	return res
+}
+
+// PaletteFromImages builds a single palette shared across
+// every image in imgs by clustering their pixels together.
+// This is useful for producing one palette for an animated
+// GIF or a sprite sheet, where PaletteImage only ever sees
+// a single frame.
+//
+// If p is specified, it is used to configure the palette.
+func PaletteFromImages(imgs []image.Image, p *PaletteConfig) color.Palette {
+	if p == nil {
+		p = &PaletteConfig{}
+	}
+	cfg := p.setDefaults()
+
+	if cfg.QuantizerMethod == Octree {
+		return octreePaletteMulti(imgs, cfg.PaletteSize)
+	}
+
+	var colors []colorVector
+	for _, img := range imgs {
+		colors = append(colors, subsampleClusterPixels(imageColors(img, cfg.ColorSpace), cfg.MaxClusterPixels, cfg.rng)...)
+	}
+	colors = subsampleClusterPixels(colors, cfg.MaxClusterPixels, cfg.rng)
+	return clusterPalette(colors, &cfg)
+}
+
+// paletteFor dispatches to the quantizer named by
+// p.QuantizerMethod.
+func paletteFor(img image.Image, p *PaletteConfig) color.Palette {
+	if p.QuantizerMethod == Octree {
+		return octreePalette(img, p.PaletteSize)
+	}
+	return kMeansPalette(img, p)
+}
+
+// imageColors collects every pixel of img as a colorVector
+// in the given color space.
+func imageColors(img image.Image, cs ColorSpace) []colorVector {
 	bounds := img.Bounds()
 	colors := make([]colorVector, 0, bounds.Dx()*bounds.Dy())
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			colors = append(colors, p.ColorSpace.toVector(img.At(x, y)))
+			colors = append(colors, cs.toVector(img.At(x, y)))
 		}
 	}
-	colors = subsampleClusterPixels(colors, p.MaxClusterPixels)
+	return colors
+}
 
-	clusters := newColorClusters(colors, p.PaletteSize)
+// kMeansPalette builds a palette by clustering a random
+// subsample of img's pixels with k-means.
+func kMeansPalette(img image.Image, p *PaletteConfig) color.Palette {
+	colors := subsampleClusterPixels(imageColors(img, p.ColorSpace), p.MaxClusterPixels, p.rng)
+	return clusterPalette(colors, p)
+}
+
+// clusterPalette runs k-means on colors and converts the
+// resulting centers into a color.Palette of size
+// p.PaletteSize.
+func clusterPalette(colors []colorVector, p *PaletteConfig) color.Palette {
+	clusters := newColorClusters(colors, p.PaletteSize, p.rng)
+	clusters.MiniBatchSize = p.MiniBatchSize
 	loss := clusters.Iterate()
 	for i := 0; i < p.MaxKMeansIters; i++ {
 		newLoss := clusters.Iterate()
@@ -94,22 +223,15 @@ func PaletteImage(img image.Image, p *PaletteConfig) *image.Paletted {
 	for i := len(clusters.Centers); i < len(palette); i++ {
 		palette[i] = palette[0]
 	}
-
-	res := image.NewPaletted(bounds, palette)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			res.Set(x, y, img.At(x, y))
-		}
-	}
-	return res
+	return palette
 }
 
-func subsampleClusterPixels(colors []colorVector, maxPixels int) []colorVector {
+func subsampleClusterPixels(colors []colorVector, maxPixels int, rng *rand.Rand) []colorVector {
 	if len(colors) <= maxPixels {
 		return colors
 	}
 	for i := 0; i < maxPixels; i++ {
-		j := rand.Intn(len(colors) - i)
+		j := rng.Intn(len(colors) - i)
 		colors[i], colors[j] = colors[j], colors[i]
 	}
 	return colors[:maxPixels]
@@ -118,29 +240,50 @@ func subsampleClusterPixels(colors []colorVector, maxPixels int) []colorVector {
 type colorClusters struct {
 	Centers   []colorVector
 	AllColors []colorVector
+	Rand      *rand.Rand
+
+	// MiniBatchSize, if non-zero, switches Iterate to
+	// Sculley-style mini-batch updates instead of a full
+	// Lloyd pass. See iterateMiniBatch.
+	MiniBatchSize int
+	centerCounts  []int
+
+	// Elkan's algorithm bookkeeping, used only in the
+	// full-batch path (MiniBatchSize == 0). assignments[i]
+	// is the center point i was last assigned to;
+	// lowerBounds[i][j] lower-bounds the distance from point
+	// i to center j; upperBounds[i] upper-bounds the
+	// distance from point i to its assigned center.
+	assignments []int
+	lowerBounds [][]float64
+	upperBounds []float64
 }
 
-func newColorClusters(allColors []colorVector, numCenters int) *colorClusters {
+func newColorClusters(allColors []colorVector, numCenters int, rng *rand.Rand) *colorClusters {
 	// Optimization for the case where there are enough
-	// centers to cover every mode exactly.
+	// centers to cover every mode exactly. Colors are kept
+	// in first-seen order (rather than map iteration order)
+	// so that results are deterministic given a seeded rng.
 	uniqueColors := map[colorVector]bool{}
+	var unique []colorVector
 	for _, c := range allColors {
-		uniqueColors[c] = true
-	}
-	if len(uniqueColors) <= numCenters {
-		unique := make([]colorVector, 0, len(uniqueColors))
-		for c := range uniqueColors {
+		if !uniqueColors[c] {
+			uniqueColors[c] = true
 			unique = append(unique, c)
 		}
+	}
+	if len(unique) <= numCenters {
 		return &colorClusters{
 			Centers:   unique,
 			AllColors: allColors,
+			Rand:      rng,
 		}
 	}
 
 	return &colorClusters{
-		Centers:   kmeansPlusPlusInit(allColors, numCenters),
+		Centers:   kmeansPlusPlusInit(allColors, numCenters, rng),
 		AllColors: allColors,
+		Rand:      rng,
 	}
 }
 
@@ -149,62 +292,220 @@ func newColorClusters(allColors []colorVector, numCenters int) *colorClusters {
 // If the MSE loss does not decrease, then the process has
 // converged.
 func (c *colorClusters) Iterate() float64 {
-	centerSum := make([]colorVector, len(c.Centers))
-	centerCount := make([]int, len(c.Centers))
+	if c.MiniBatchSize > 0 {
+		return c.iterateMiniBatch()
+	}
+	return c.iterateElkan()
+}
+
+// iterateElkan performs a full-batch Lloyd step, using
+// Elkan's algorithm to avoid recomputing the distance from
+// every point to every center when the triangle inequality
+// proves a center cannot be closer than the one a point is
+// already assigned to.
+func (c *colorClusters) iterateElkan() float64 {
+	k := len(c.Centers)
+	if c.assignments == nil {
+		c.initElkanState()
+	}
+
+	centerDists, halfMinCenterDist := c.centerDistances()
+
+	centerSum := make([]colorVector, k)
+	centerCount := make([]int, k)
 	totalError := 0.0
 
 	numProcs := runtime.GOMAXPROCS(0)
 	var resultLock sync.Mutex
 	var wg sync.WaitGroup
-	for i := 0; i < numProcs; i++ {
+	for p := 0; p < numProcs; p++ {
 		wg.Add(1)
 		go func(idx int) {
 			defer wg.Done()
-			localCenterSum := make([]colorVector, len(c.Centers))
-			localCenterCount := make([]int, len(c.Centers))
+			localCenterSum := make([]colorVector, k)
+			localCenterCount := make([]int, k)
 			localTotalError := 0.0
 			for i := idx; i < len(c.AllColors); i += numProcs {
 				co := c.AllColors[i]
-				closestDist := 0.0
-				closestIdx := 0
-				for i, center := range c.Centers {
-					d := float64(co.DistSquared(center))
-					if d < closestDist || i == 0 {
-						closestDist = d
-						closestIdx = i
+				assigned := c.assignments[i]
+
+				if c.upperBounds[i] > halfMinCenterDist[assigned] {
+					tight := false
+					for j := 0; j < k; j++ {
+						if j == assigned {
+							continue
+						}
+						if c.upperBounds[i] <= c.lowerBounds[i][j] {
+							continue
+						}
+						if c.upperBounds[i] <= 0.5*centerDists[assigned][j] {
+							continue
+						}
+						if !tight {
+							d := math.Sqrt(float64(co.DistSquared(c.Centers[assigned])))
+							c.lowerBounds[i][assigned] = d
+							c.upperBounds[i] = d
+							tight = true
+							if c.upperBounds[i] <= c.lowerBounds[i][j] ||
+								c.upperBounds[i] <= 0.5*centerDists[assigned][j] {
+								continue
+							}
+						}
+						d := math.Sqrt(float64(co.DistSquared(c.Centers[j])))
+						c.lowerBounds[i][j] = d
+						if d < c.upperBounds[i] {
+							assigned = j
+							c.upperBounds[i] = d
+						}
 					}
+					c.assignments[i] = assigned
 				}
-				localCenterSum[closestIdx] = localCenterSum[closestIdx].Add(co)
-				localCenterCount[closestIdx]++
+
+				closestDist := float64(co.DistSquared(c.Centers[assigned]))
+				localCenterSum[assigned] = localCenterSum[assigned].Add(co)
+				localCenterCount[assigned]++
 				localTotalError += closestDist
 			}
 			resultLock.Lock()
 			defer resultLock.Unlock()
-			for i, c := range localCenterCount {
-				centerCount[i] += c
+			for i, cnt := range localCenterCount {
+				centerCount[i] += cnt
 			}
 			for i, s := range localCenterSum {
 				centerSum[i] = centerSum[i].Add(s)
 			}
 			totalError += localTotalError
-		}(i)
+		}(p)
 	}
 	wg.Wait()
 
+	moves := make([]float64, k)
 	for i, newCenter := range centerSum {
 		count := centerCount[i]
 		if count > 0 {
-			c.Centers[i] = newCenter.Scale(1 / float32(count))
+			updated := newCenter.Scale(1 / float32(count))
+			moves[i] = math.Sqrt(float64(updated.DistSquared(c.Centers[i])))
+			c.Centers[i] = updated
+		}
+	}
+
+	// Loosen bounds (lower bounds shrink, upper bounds grow)
+	// to account for how far each center moved,
+	// per Elkan's algorithm, instead of recomputing them from
+	// scratch on the next iteration.
+	for i := range c.AllColors {
+		for j, move := range moves {
+			c.lowerBounds[i][j] -= move
+			if c.lowerBounds[i][j] < 0 {
+				c.lowerBounds[i][j] = 0
+			}
 		}
+		c.upperBounds[i] += moves[c.assignments[i]]
 	}
 
 	return totalError / float64(len(c.AllColors))
 }
 
-func kmeansPlusPlusInit(allColors []colorVector, numCenters int) []colorVector {
+// initElkanState computes the initial assignment of every
+// point to its nearest center by brute force, and seeds the
+// lower/upper bounds used by iterateElkan from then on.
+func (c *colorClusters) initElkanState() {
+	k := len(c.Centers)
+	c.assignments = make([]int, len(c.AllColors))
+	c.lowerBounds = make([][]float64, len(c.AllColors))
+	c.upperBounds = make([]float64, len(c.AllColors))
+	for i, co := range c.AllColors {
+		bounds := make([]float64, k)
+		bestIdx := 0
+		bestDist := math.Inf(1)
+		for j, center := range c.Centers {
+			d := math.Sqrt(float64(co.DistSquared(center)))
+			bounds[j] = d
+			if d < bestDist {
+				bestDist = d
+				bestIdx = j
+			}
+		}
+		c.lowerBounds[i] = bounds
+		c.assignments[i] = bestIdx
+		c.upperBounds[i] = bestDist
+	}
+}
+
+// centerDistances returns the full K x K matrix of
+// inter-center distances, plus, for each center, half its
+// distance to the nearest other center (the s(c) term from
+// Elkan's algorithm: no point within that distance of its
+// assigned center can be reassigned).
+func (c *colorClusters) centerDistances() ([][]float64, []float64) {
+	k := len(c.Centers)
+	dists := make([][]float64, k)
+	halfMin := make([]float64, k)
+	for i := range dists {
+		dists[i] = make([]float64, k)
+		halfMin[i] = math.Inf(1)
+	}
+	for i := 0; i < k; i++ {
+		for j := i + 1; j < k; j++ {
+			d := math.Sqrt(float64(c.Centers[i].DistSquared(c.Centers[j])))
+			dists[i][j] = d
+			dists[j][i] = d
+			if d < halfMin[i]*2 {
+				halfMin[i] = d / 2
+			}
+			if d < halfMin[j]*2 {
+				halfMin[j] = d / 2
+			}
+		}
+	}
+	return dists, halfMin
+}
+
+// iterateMiniBatch performs a Sculley-style mini-batch
+// update: a random batch of MiniBatchSize points (sampled
+// with replacement, as in the original paper) is assigned to
+// its nearest centers, and each center is nudged towards the
+// mean of the points assigned to it in this batch, using a
+// per-center learning rate of 1/count that decays as that
+// center accumulates more assignments across iterations.
+func (c *colorClusters) iterateMiniBatch() float64 {
+	if c.centerCounts == nil {
+		c.centerCounts = make([]int, len(c.Centers))
+	}
+
+	totalError := 0.0
+	for b := 0; b < c.MiniBatchSize; b++ {
+		co := c.AllColors[c.Rand.Intn(len(c.AllColors))]
+
+		closestDist := float64(0)
+		closestIdx := 0
+		for j, center := range c.Centers {
+			d := float64(co.DistSquared(center))
+			if d < closestDist || j == 0 {
+				closestDist = d
+				closestIdx = j
+			}
+		}
+		totalError += closestDist
+
+		c.centerCounts[closestIdx]++
+		eta := float32(1) / float32(c.centerCounts[closestIdx])
+		c.Centers[closestIdx] = c.Centers[closestIdx].Scale(1 - eta).Add(co.Scale(eta))
+	}
+
+	// Reset Elkan state, since the centers moved without the
+	// bookkeeping iterateElkan relies on; a subsequent
+	// full-batch Iterate call (e.g. a final refinement pass)
+	// will simply recompute it from scratch.
+	c.assignments = nil
+
+	return totalError / float64(c.MiniBatchSize)
+}
+
+func kmeansPlusPlusInit(allColors []colorVector, numCenters int, rng *rand.Rand) []colorVector {
 	centers := make([]colorVector, numCenters)
-	centers[0] = allColors[rand.Intn(len(allColors))]
-	dists := newCenterDistances(allColors, centers[0])
+	centers[0] = allColors[rng.Intn(len(allColors))]
+	dists := newCenterDistances(allColors, centers[0], rng)
 	for i := 1; i < numCenters; i++ {
 		sampleIdx := dists.Sample()
 		centers[i] = allColors[sampleIdx]
@@ -217,9 +518,10 @@ type centerDistances struct {
 	AllColors   []colorVector
 	Distances   []float64
 	DistanceSum float64
+	Rand        *rand.Rand
 }
 
-func newCenterDistances(allColors []colorVector, center colorVector) *centerDistances {
+func newCenterDistances(allColors []colorVector, center colorVector, rng *rand.Rand) *centerDistances {
 	dists := make([]float64, len(allColors))
 	sum := 0.0
 	for i, c := range allColors {
@@ -230,6 +532,7 @@ func newCenterDistances(allColors []colorVector, center colorVector) *centerDist
 		AllColors:   allColors,
 		Distances:   dists,
 		DistanceSum: sum,
+		Rand:        rng,
 	}
 }
 
@@ -245,7 +548,7 @@ func (c *centerDistances) Update(newCenter colorVector) {
 }
 
 func (c *centerDistances) Sample() int {
-	sample := rand.Float64() * c.DistanceSum
+	sample := c.Rand.Float64() * c.DistanceSum
 	idx := len(c.AllColors) - 1
 	for i, dist := range c.Distances {
 		sample -= dist
@@ -1,45 +1,133 @@
 package smallpng
 
 import (
+	"fmt"
 	"image"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
+	"io"
 	"os"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/webp"
 )
 
+func init() {
+	image.RegisterFormat("bmp", "BM", bmp.Decode, bmp.DecodeConfig)
+	image.RegisterFormat("webp", "RIFF????WEBP", webp.Decode, webp.DecodeConfig)
+}
+
 type Config struct {
 	NoPalette        bool
 	PaletteSize      int
 	MaxIters         int
 	MaxClusterPixels int
+
+	// QuantizerMethod selects the palette-generation
+	// algorithm. If unspecified, KMeans is used.
+	QuantizerMethod QuantizerMethod
+
+	// Dither selects how pixels are mapped onto the
+	// generated palette. If unspecified, DitherNone is
+	// used.
+	Dither Dither
+
+	// InputFormat names the format of the input image
+	// (e.g. "png", "jpeg", "gif", "bmp", "webp"), bypassing
+	// format sniffing. If empty, the format is detected
+	// automatically.
+	InputFormat string
+
+	// MaxMemoryBytes, if non-zero, switches palette
+	// generation to StreamPaletteImage and bounds its
+	// per-tile working memory. See PaletteConfig.MaxMemoryBytes.
+	// It does not bound decoding: ReadImage fully decodes
+	// inPath into memory before StreamPaletteImage ever runs,
+	// so the decoded image's own size is unaffected by this
+	// setting.
+	MaxMemoryBytes int
+
+	// MiniBatchSize, if non-zero, uses mini-batch k-means
+	// instead of full-batch Lloyd iterations. See
+	// PaletteConfig.MiniBatchSize.
+	MiniBatchSize int
+
+	// Seed, if non-zero, makes palette generation
+	// reproducible across runs. See PaletteConfig.Seed.
+	Seed int64
 }
 
 // CompressImage reads an image from inPath and saves the
-// compressed version to outPath.
+// compressed version to outPath. inPath may be "-" to read
+// from stdin. The image is always fully decoded into memory
+// by ReadImage first; MaxMemoryBytes only bounds the work done
+// afterward, in StreamPaletteImage.
 func CompressImage(inPath, outPath string, c *Config) error {
 	if c == nil {
 		c = &Config{}
 	}
-	img, err := ReadImage(inPath)
+	img, err := ReadImage(inPath, c.InputFormat)
 	if err != nil {
 		return err
 	}
-	if !c.NoPalette {
-		img = PaletteImage(img, &PaletteConfig{
-			MaxKMeansIters:   c.MaxIters,
-			PaletteSize:      c.PaletteSize,
-			MaxClusterPixels: c.MaxClusterPixels,
-		})
+	if c.NoPalette {
+		return WriteImage(outPath, img)
+	}
+	paletteConfig := &PaletteConfig{
+		MaxKMeansIters:   c.MaxIters,
+		PaletteSize:      c.PaletteSize,
+		MaxClusterPixels: c.MaxClusterPixels,
+		QuantizerMethod:  c.QuantizerMethod,
+		Dither:           c.Dither,
+		MaxMemoryBytes:   c.MaxMemoryBytes,
+		MiniBatchSize:    c.MiniBatchSize,
+		Seed:             c.Seed,
+	}
+	if c.MaxMemoryBytes > 0 {
+		return StreamPaletteImage(img, paletteConfig, outPath)
 	}
-	return WriteImage(outPath, img)
+	return WriteImage(outPath, PaletteImage(img, paletteConfig))
 }
 
-func ReadImage(path string) (image.Image, error) {
-	r, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// ReadImage reads an image from path, sniffing its format
+// unless format is non-empty, in which case it names the
+// format explicitly (e.g. "jpeg") instead. As a convenience
+// for CLI pipelines, path may be "-" to read from stdin, in
+// which case format must be specified.
+func ReadImage(path, format string) (image.Image, error) {
+	var r io.Reader
+	if path == "-" {
+		if format == "" {
+			return nil, fmt.Errorf("must specify a format when reading from stdin")
+		}
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	switch format {
+	case "":
+		img, _, err := image.Decode(r)
+		return img, err
+	case "png":
+		return png.Decode(r)
+	case "jpeg":
+		return jpeg.Decode(r)
+	case "gif":
+		return gif.Decode(r)
+	case "bmp":
+		return bmp.Decode(r)
+	case "webp":
+		return webp.Decode(r)
+	default:
+		return nil, fmt.Errorf("unknown input format: %s", format)
 	}
-	defer r.Close()
-	return png.Decode(r)
 }
 
 func WriteImage(path string, img image.Image) error {
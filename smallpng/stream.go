@@ -0,0 +1,196 @@
+package smallpng
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+)
+
+// defaultTileRowBytes approximates the per-pixel working
+// set (a colorVector plus bookkeeping) used while building
+// and applying a palette, which lets MaxMemoryBytes be
+// translated into a tile height.
+const defaultTileRowBytes = 64
+
+// tileRowCount picks how many image rows fit in a single
+// tile under maxMemoryBytes. A non-positive maxMemoryBytes
+// disables tiling, and the whole image height is returned.
+func tileRowCount(width, height, maxMemoryBytes int) int {
+	if maxMemoryBytes <= 0 {
+		return height
+	}
+	rowBytes := width * defaultTileRowBytes
+	if rowBytes <= 0 {
+		rowBytes = defaultTileRowBytes
+	}
+	rows := maxMemoryBytes / rowBytes
+	if rows < 1 {
+		rows = 1
+	}
+	if rows > height {
+		rows = height
+	}
+	return rows
+}
+
+// reservoirSampler maintains a uniformly random sample of
+// at most max colorVectors seen so far, using Algorithm R.
+// Unlike subsampleClusterPixels, it never needs to hold
+// more than max samples, so pixels can be streamed through
+// it tile-by-tile instead of being collected into a single
+// width*height slice first.
+type reservoirSampler struct {
+	samples []colorVector
+	max     int
+	seen    int
+	rng     *rand.Rand
+}
+
+func newReservoirSampler(max int, rng *rand.Rand) *reservoirSampler {
+	return &reservoirSampler{
+		samples: make([]colorVector, 0, max),
+		max:     max,
+		rng:     rng,
+	}
+}
+
+func (r *reservoirSampler) Add(v colorVector) {
+	r.seen++
+	if len(r.samples) < r.max {
+		r.samples = append(r.samples, v)
+		return
+	}
+	j := r.rng.Intn(r.seen)
+	if j < r.max {
+		r.samples[j] = v
+	}
+}
+
+// StreamPaletteImage builds a palette for img and encodes the
+// dithered result to path as a paletted PNG, tile by tile,
+// which matters for very large inputs. Unlike PaletteImage, it
+// never allocates a colorVector or a palette index per pixel in
+// the whole image at once: k-means clustering works on a
+// reservoir sample of at most MaxClusterPixels colors, and
+// dithering and encoding hold one tile at a time, whose height
+// MaxMemoryBytes (falling back to DefaultMaxMemoryBytes)
+// controls. The Octree method builds its palette from every
+// pixel of img rather than from the sample.
+//
+// These bounds cover sampling, quantization, and output encoding
+// only. img itself must already be fully decoded and resident
+// in memory before it's passed in; StreamPaletteImage reads
+// pixels back out of it tile by tile, but does not control how
+// img was produced. Callers decoding very large files (see
+// CompressImage) should expect the decoded image to dominate
+// memory use, independent of MaxMemoryBytes.
+//
+// If p is specified, it is used to configure the palette.
+func StreamPaletteImage(img image.Image, p *PaletteConfig, path string) error {
+	if p == nil {
+		p = &PaletteConfig{}
+	}
+	cfg := p.setDefaults()
+
+	bounds := img.Bounds()
+	rows := tileRowCount(bounds.Dx(), bounds.Dy(), cfg.MaxMemoryBytes)
+
+	sampler := newReservoirSampler(cfg.MaxClusterPixels, cfg.rng)
+	forEachTile(bounds, rows, func(tile image.Rectangle) {
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				sampler.Add(cfg.ColorSpace.toVector(img.At(x, y)))
+			}
+		}
+	})
+
+	var palette color.Palette
+	if cfg.QuantizerMethod == Octree {
+		palette = octreePalette(img, cfg.PaletteSize)
+	} else {
+		palette = clusterPalette(sampler.samples, &cfg)
+	}
+
+	w, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	enc := png.Encoder{
+		CompressionLevel: png.BestCompression,
+	}
+	return enc.Encode(w, &tileImage{
+		bounds:  bounds,
+		palette: palette,
+		rows:    rows,
+		p:       &cfg,
+		src:     img,
+	})
+}
+
+// tileImage adapts StreamPaletteImage's tile-by-tile
+// dithering to the image.Image interface so it can be handed
+// straight to png.Encode. png.Encode visits pixels in
+// row-major order, so at any moment only the single tile
+// containing the row currently being encoded is held in
+// memory, instead of a whole-image palette index buffer.
+type tileImage struct {
+	bounds  image.Rectangle
+	palette color.Palette
+	rows    int
+	p       *PaletteConfig
+	src     image.Image
+
+	tile image.Rectangle
+	buf  *image.Paletted
+}
+
+func (t *tileImage) ColorModel() color.Model { return t.palette }
+func (t *tileImage) Bounds() image.Rectangle { return t.bounds }
+
+func (t *tileImage) At(x, y int) color.Color {
+	if t.buf == nil || y < t.tile.Min.Y || y >= t.tile.Max.Y {
+		t.loadTile(y)
+	}
+	return t.buf.At(x, y)
+}
+
+// ColorIndexAt implements image.PalettedImage, which png.Encode
+// requires in order to write a paletted PNG.
+func (t *tileImage) ColorIndexAt(x, y int) uint8 {
+	if t.buf == nil || y < t.tile.Min.Y || y >= t.tile.Max.Y {
+		t.loadTile(y)
+	}
+	return t.buf.ColorIndexAt(x, y)
+}
+
+// loadTile dithers just the tile containing row y, discarding
+// whatever tile was previously loaded.
+func (t *tileImage) loadTile(y int) {
+	top := t.bounds.Min.Y + ((y-t.bounds.Min.Y)/t.rows)*t.rows
+	bottom := top + t.rows
+	if bottom > t.bounds.Max.Y {
+		bottom = t.bounds.Max.Y
+	}
+	t.tile = image.Rect(t.bounds.Min.X, top, t.bounds.Max.X, bottom)
+	t.buf = image.NewPaletted(t.tile, t.palette)
+	ditherImage(t.buf, t.src, t.tile, t.palette, t.p)
+}
+
+// forEachTile calls f once per horizontal strip of bounds,
+// each strip (other than possibly the last) containing
+// rows rows.
+func forEachTile(bounds image.Rectangle, rows int, f func(tile image.Rectangle)) {
+	if rows <= 0 {
+		rows = bounds.Dy()
+	}
+	for top := bounds.Min.Y; top < bounds.Max.Y; top += rows {
+		bottom := top + rows
+		if bottom > bounds.Max.Y {
+			bottom = bounds.Max.Y
+		}
+		f(image.Rect(bounds.Min.X, top, bounds.Max.X, bottom))
+	}
+}
@@ -0,0 +1,100 @@
+package smallpng
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// proceduralImage is an image.Image whose pixels are
+// computed on the fly instead of stored, so tests can
+// exercise huge dimensions without allocating a real pixel
+// buffer.
+type proceduralImage struct {
+	rect image.Rectangle
+}
+
+func (p *proceduralImage) ColorModel() color.Model { return color.RGBAModel }
+func (p *proceduralImage) Bounds() image.Rectangle { return p.rect }
+
+func (p *proceduralImage) At(x, y int) color.Color {
+	return color.RGBA{
+		R: uint8(x),
+		G: uint8(y),
+		B: uint8(x + y),
+		A: 0xff,
+	}
+}
+
+func TestTileRowCount(t *testing.T) {
+	if n := tileRowCount(1000, 500, 0); n != 500 {
+		t.Errorf("expected no tiling to return full height, got %d", n)
+	}
+	if n := tileRowCount(1000, 500, 1000*defaultTileRowBytes); n != 1 {
+		t.Errorf("expected a single row per tile, got %d", n)
+	}
+}
+
+// TestTileImageBoundedTileSize asserts that tileImage, which
+// StreamPaletteImage hands to png.Encode in place of a
+// whole-image *image.Paletted, never holds more than one
+// tile's worth of dithered pixels at a time, regardless of
+// the full image's size. png.Encode visits pixels in
+// row-major order, so walking every row the same way here
+// reproduces how the encoder actually drives tileImage.
+func TestTileImageBoundedTileSize(t *testing.T) {
+	const width, height, rows = 4000, 4000, 7
+	bounds := image.Rect(0, 0, width, height)
+	img := &tileImage{
+		bounds:  bounds,
+		palette: color.Palette{color.Gray{Y: 0}, color.Gray{Y: 255}},
+		rows:    rows,
+		p:       &PaletteConfig{},
+		src:     &proceduralImage{rect: bounds},
+	}
+
+	loads := 0
+	lastTile := image.Rectangle{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.At(x, y)
+		}
+		if img.tile != lastTile {
+			loads++
+			lastTile = img.tile
+		}
+		if h := img.tile.Dy(); h > rows {
+			t.Fatalf("tile at y=%d has height %d, want at most %d", y, h, rows)
+		}
+	}
+
+	if want := (height + rows - 1) / rows; loads != want {
+		t.Errorf("loaded %d tiles, want %d", loads, want)
+	}
+}
+
+// BenchmarkStreamPaletteImageLargeImage exercises
+// StreamPaletteImage on a very large image, using a
+// procedurally-generated 20000x20000 image so the benchmark
+// measures only what StreamPaletteImage itself bounds: sampling,
+// quantization, and tile-by-tile encoding. It intentionally does
+// not decode a real file first, since that decode (see ReadImage)
+// is unbounded and would dominate the numbers here; it is not
+// part of what MaxMemoryBytes controls.
+func BenchmarkStreamPaletteImageLargeImage(b *testing.B) {
+	img := &proceduralImage{rect: image.Rect(0, 0, 20000, 20000)}
+	p := &PaletteConfig{
+		PaletteSize:      16,
+		MaxClusterPixels: 10000,
+		MaxMemoryBytes:   4 << 20,
+	}
+	path := filepath.Join(b.TempDir(), "out.png")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := StreamPaletteImage(img, p, path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}